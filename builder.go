@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+type builderKind string
+
+const (
+	builderDocker   builderKind = "docker"
+	builderGGCR     builderKind = "ggcr"
+	builderBuildKit builderKind = "buildkit"
+)
+
+func parseBuilderKind(raw string) (builderKind, error) {
+	switch builderKind(strings.ToLower(strings.TrimSpace(raw))) {
+	case builderDocker, "":
+		return builderDocker, nil
+	case builderGGCR:
+		return builderGGCR, nil
+	case builderBuildKit:
+		return builderBuildKit, nil
+	default:
+		return "", fmt.Errorf("unsupported --builder value %q", raw)
+	}
+}
+
+func parsePlatforms(raw string) []string {
+	parts := strings.Split(raw, ",")
+	result := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
+
+// builtImage holds whichever artifact a builder produced: a single-arch
+// v1.Image, or a v1.ImageIndex for multi-platform builds. ggcrBuilder sets
+// exactly one of the two; dockerBuilder sets neither, since its image lives
+// in the local docker image store (or was already pushed by buildx).
+type builtImage struct {
+	image v1.Image
+	index v1.ImageIndex
+}
+
+// imageBuilder abstracts how crunchy produces and uploads the deployable
+// image, so the docker CLI is just one of several pluggable backends.
+type imageBuilder interface {
+	Build(ctx context.Context, dir, tag string) (builtImage, error)
+	Push(ctx context.Context, built builtImage, ref string) (digest string, err error)
+}
+
+func newImageBuilder(cfg *config) (imageBuilder, error) {
+	switch cfg.builder {
+	case builderDocker, "":
+		return &dockerBuilder{cfg: cfg}, nil
+	case builderGGCR:
+		return &ggcrBuilder{cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("builder %q is not implemented yet", cfg.builder)
+	}
+}
+
+// dockerBuilder shells out to the docker CLI, matching crunchy's original
+// behavior. For a single platform it drives `docker build`/`docker push`
+// as before; for multiple platforms it switches to `docker buildx build
+// --push`, which pushes as part of the build, so Push just returns the
+// digest buildx already reported via its metadata file.
+type dockerBuilder struct {
+	cfg             *config
+	multiArchDigest string
+}
+
+func (b *dockerBuilder) Build(ctx context.Context, dir, tag string) (builtImage, error) {
+	if len(b.cfg.platforms) > 1 {
+		return builtImage{}, b.buildMultiArch(ctx, dir, tag)
+	}
+
+	platform := "linux/amd64"
+	if len(b.cfg.platforms) == 1 {
+		platform = b.cfg.platforms[0]
+	}
+
+	args := []string{"build", "--platform", platform}
+	if b.cfg.dockerfile != "" {
+		args = append(args, "-f", b.cfg.dockerfile)
+	}
+	args = append(args, "-t", tag, dir)
+
+	if err := runDockerCommand(ctx, b.cfg, args); err != nil {
+		return builtImage{}, fmt.Errorf("docker build: %w", err)
+	}
+	return builtImage{}, nil
+}
+
+func (b *dockerBuilder) buildMultiArch(ctx context.Context, dir, tag string) error {
+	metadataFile, err := os.CreateTemp("", "crunchy-buildx-metadata-*.json")
+	if err != nil {
+		return fmt.Errorf("create buildx metadata file: %w", err)
+	}
+	metadataFile.Close()
+	defer os.Remove(metadataFile.Name())
+
+	args := []string{
+		"buildx", "build",
+		"--push",
+		"--platform=" + strings.Join(b.cfg.platforms, ","),
+		"--metadata-file", metadataFile.Name(),
+	}
+	if b.cfg.dockerfile != "" {
+		args = append(args, "-f", b.cfg.dockerfile)
+	}
+	args = append(args, "-t", tag, dir)
+
+	if err := runDockerCommand(ctx, b.cfg, args); err != nil {
+		return fmt.Errorf("docker buildx build: %w", err)
+	}
+
+	digest, err := readBuildxDigest(metadataFile.Name())
+	if err != nil {
+		return err
+	}
+	b.multiArchDigest = digest
+	return nil
+}
+
+func readBuildxDigest(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read buildx metadata file: %w", err)
+	}
+
+	var meta struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return "", fmt.Errorf("parse buildx metadata file: %w", err)
+	}
+	if meta.Digest == "" {
+		return "", errors.New("containerimage.digest missing from buildx metadata file")
+	}
+	return meta.Digest, nil
+}
+
+func (b *dockerBuilder) Push(ctx context.Context, _ builtImage, ref string) (string, error) {
+	if b.multiArchDigest != "" {
+		return b.multiArchDigest, nil
+	}
+
+	output, err := runDockerPush(ctx, b.cfg, ref)
+	if err != nil {
+		return "", fmt.Errorf("docker push: %w\n%s", err, output)
+	}
+	return parseDigest(output)
+}
+
+// ggcrBuilder still needs the docker CLI (with buildx) installed to turn a
+// Dockerfile into an image — that part isn't reimplemented here. What it
+// avoids is everything downstream of the build: Build asks docker to emit a
+// docker-save-format tarball via `docker build --output=type=docker` instead
+// of loading the result into the local image store, and Push then goes
+// straight from that tarball to the registry via go-containerregistry with
+// ADC (remote.WithAuthFromKeychain(google.Keychain)), so there's no local
+// daemon/image store involved in push and no `docker login`. For multiple
+// platforms it builds one tarball per platform and assembles them into a
+// single manifest-list image index.
+type ggcrBuilder struct {
+	cfg      *config
+	tarPaths []string
+}
+
+// Build drives one `docker build --output=type=docker` per platform. The
+// resulting tarballs are kept on disk and tracked in b.tarPaths rather than
+// removed here: tarball.ImageFromPath returns an image that re-reads the
+// file lazily as its layers are consumed, so it must still exist when Push
+// streams it to the registry. Push removes them once it's done; if Build
+// itself fails partway through, it removes whatever tarballs it already
+// produced instead of leaking them since Push will never be called.
+func (b *ggcrBuilder) Build(ctx context.Context, dir, _ string) (built builtImage, err error) {
+	defer func() {
+		if err != nil {
+			for _, p := range b.tarPaths {
+				os.Remove(p)
+			}
+			b.tarPaths = nil
+		}
+	}()
+
+	if len(b.cfg.platforms) > 1 {
+		addenda := make([]mutate.IndexAddendum, 0, len(b.cfg.platforms))
+		for _, platform := range b.cfg.platforms {
+			tarPath, err := b.buildTar(ctx, dir, platform)
+			if err != nil {
+				return builtImage{}, err
+			}
+			b.tarPaths = append(b.tarPaths, tarPath)
+
+			img, err := tarball.ImageFromPath(tarPath, nil)
+			if err != nil {
+				return builtImage{}, fmt.Errorf("load image tarball %s: %w", tarPath, err)
+			}
+			addenda = append(addenda, mutate.IndexAddendum{Add: img})
+		}
+		return builtImage{index: mutate.AppendManifests(empty.Index, addenda...)}, nil
+	}
+
+	platform := "linux/amd64"
+	if len(b.cfg.platforms) == 1 {
+		platform = b.cfg.platforms[0]
+	}
+
+	tarPath, err := b.buildTar(ctx, dir, platform)
+	if err != nil {
+		return builtImage{}, err
+	}
+	b.tarPaths = append(b.tarPaths, tarPath)
+
+	img, err := tarball.ImageFromPath(tarPath, nil)
+	if err != nil {
+		return builtImage{}, fmt.Errorf("load image tarball %s: %w", tarPath, err)
+	}
+	return builtImage{image: img}, nil
+}
+
+// buildTar drives `docker build --output=type=docker` for one platform,
+// writing the resulting docker-save-format tarball (the format
+// tarball.ImageFromPath expects: a manifest.json at the tar root, not an OCI
+// layout) to a temp file whose path it returns.
+func (b *ggcrBuilder) buildTar(ctx context.Context, dir, platform string) (string, error) {
+	tarFile, err := os.CreateTemp("", "crunchy-ggcr-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("create build output file: %w", err)
+	}
+	tarFile.Close()
+
+	args := []string{"build", "--platform", platform}
+	if b.cfg.dockerfile != "" {
+		args = append(args, "-f", b.cfg.dockerfile)
+	}
+	args = append(args, "--output=type=docker,dest="+tarFile.Name(), dir)
+
+	if err := runDockerCommand(ctx, b.cfg, args); err != nil {
+		os.Remove(tarFile.Name())
+		return "", fmt.Errorf("docker build (tar output): %w", err)
+	}
+	return tarFile.Name(), nil
+}
+
+func (b *ggcrBuilder) Push(ctx context.Context, built builtImage, ref string) (string, error) {
+	defer func() {
+		for _, p := range b.tarPaths {
+			os.Remove(p)
+		}
+	}()
+
+	tag, err := name.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("parse image reference %s: %w", ref, err)
+	}
+
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(google.Keychain)}
+
+	if built.index != nil {
+		if err := remote.WriteIndex(tag, built.index, opts...); err != nil {
+			return "", fmt.Errorf("push image index %s: %w", ref, err)
+		}
+		digest, err := built.index.Digest()
+		if err != nil {
+			return "", fmt.Errorf("compute digest for %s: %w", ref, err)
+		}
+		return digest.String(), nil
+	}
+
+	if err := remote.Write(tag, built.image, opts...); err != nil {
+		return "", fmt.Errorf("push image %s: %w", ref, err)
+	}
+	digest, err := built.image.Digest()
+	if err != nil {
+		return "", fmt.Errorf("compute digest for %s: %w", ref, err)
+	}
+	return digest.String(), nil
+}
+
+// retainedChildDigests inspects each kept digest and, where it is itself a
+// manifest list, returns the set of child manifest digests it references so
+// cleanupOldImages doesn't delete an image that a retained index still
+// points at.
+func retainedChildDigests(ctx context.Context, repo string, keepDigests []string) map[string]bool {
+	children := make(map[string]bool)
+
+	for _, d := range keepDigests {
+		ref, err := name.ParseReference(fmt.Sprintf("%s@%s", repo, d))
+		if err != nil {
+			continue
+		}
+
+		idx, err := remote.Index(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(google.Keychain))
+		if err != nil {
+			continue
+		}
+
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			continue
+		}
+
+		for _, m := range manifest.Manifests {
+			children[m.Digest.String()] = true
+		}
+	}
+
+	return children
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -17,26 +18,26 @@ const (
 	langRust language = "rust"
 )
 
-func buildProject(cfg *config) error {
+func buildProject(ctx context.Context, cfg *config) error {
 	switch cfg.lang {
 	case langPNPM:
-		if err := runCommandStreaming(cfg.workdir, "pnpm", "run", "build"); err != nil {
+		if err := runCommandStreaming(ctx, cfg.workdir, "pnpm", "run", "build"); err != nil {
 			return fmt.Errorf("build project with pnpm: %w", err)
 		}
 	case langNPM:
-		if err := runCommandStreaming(cfg.workdir, "npm", "run", "build"); err != nil {
+		if err := runCommandStreaming(ctx, cfg.workdir, "npm", "run", "build"); err != nil {
 			return fmt.Errorf("build project with npm: %w", err)
 		}
 	case langYarn:
-		if err := runCommandStreaming(cfg.workdir, "yarn", "build"); err != nil {
+		if err := runCommandStreaming(ctx, cfg.workdir, "yarn", "build"); err != nil {
 			return fmt.Errorf("build project with yarn: %w", err)
 		}
 	case langGo:
-		if err := runCommandStreaming(cfg.workdir, "go", "build", "./..."); err != nil {
+		if err := runCommandStreaming(ctx, cfg.workdir, "go", "build", "./..."); err != nil {
 			return fmt.Errorf("build project with go: %w", err)
 		}
 	case langRust:
-		if err := runCommandStreaming(cfg.workdir, "cargo", "build", "--release"); err != nil {
+		if err := runCommandStreaming(ctx, cfg.workdir, "cargo", "build", "--release"); err != nil {
 			return fmt.Errorf("build project with cargo: %w", err)
 		}
 	default:
@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,85 +27,149 @@ type config struct {
 	project  string
 	region   string
 	registryHost string
+	noProgress bool
+	silent   bool
+	builder  builderKind
+	platforms []string
+	registryKind registryKind
+	repository string
+	lang     language
+	dockerfile string
+	targetLabel string
 }
 
 func main() {
-	cfg, err := parseConfig()
+	flags, flagSet, err := parseFlags()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
-	if err := run(cfg); err != nil {
+	ctx, cancel := installSignalHandler()
+	defer cancel()
+
+	targets, err := resolveTargets(flags, flagSet)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("⚡ Done in %.1fs\n", time.Since(cfg.start).Seconds())
+	for _, cfg := range targets {
+		cfg.start = time.Now()
+
+		if cfg.targetLabel != "" && !cfg.silent {
+			fmt.Printf("== %s ==\n", cfg.targetLabel)
+		}
+
+		if err := run(ctx, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("⚡ Done in %.1fs\n", time.Since(cfg.start).Seconds())
+	}
+}
+
+// installSignalHandler returns a context that is cancelled on the first
+// SIGINT/SIGTERM/SIGQUIT so in-flight commands can be aborted and rolled
+// back. A second signal hard-exits immediately without waiting on cleanup.
+func installSignalHandler() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		sig := <-sigCh
+		fmt.Fprintf(os.Stderr, "\nAborting... (%s received, waiting for children to exit)\n", sig)
+		cancel()
+
+		<-sigCh
+		fmt.Fprintln(os.Stderr, "second signal received, exiting now")
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
 }
 
-func parseConfig() (*config, error) {
-	image := flag.String("image", "", "Docker image name (required)")
-	svc := flag.String("svc", "", "Semicolon separated Cloud Run services (required)")
+// flagValues holds every flag as the user (or its default) set it, before
+// any crunchy.yaml merge happens. Required-field validation is deferred to
+// buildFlagOnlyConfig/buildTargetConfig since a config file can supply
+// fields the command line leaves blank.
+type flagValues struct {
+	image        string
+	svc          string
+	beta         bool
+	keepImgs     int
+	keepRevs     int
+	project      string
+	region       string
+	registryHost string
+	noProgress   bool
+	silent       bool
+	builder      string
+	platforms    string
+	registry     string
+	repository   string
+	lang         string
+	dockerfile   string
+	configPath   string
+	only         string
+	env          string
+}
+
+func parseFlags() (*flagValues, map[string]bool, error) {
+	image := flag.String("image", "", "Docker image name (required unless set per-target in --config)")
+	svc := flag.String("svc", "", "Semicolon separated Cloud Run services (required unless set per-target in --config)")
 	beta := flag.Bool("beta", false, "Use dev tag and skip cleanup")
 	keepImgs := flag.Int("keep-images", 10, "Number of Docker image digests to retain (>=1)")
 	keepRevs := flag.Int("keep-revisions", 10, "Number of Cloud Run revisions to retain (>=1)")
-	project := flag.String("project", "", "GCP project to deploy to (required)")
-	region := flag.String("region", "", "Cloud Run region (required)")
+	project := flag.String("project", "", "GCP project to deploy to (required unless set per-environment in --config)")
+	region := flag.String("region", "", "Cloud Run region (required unless set per-environment in --config)")
 	registryHost := flag.String("registry-host", "", "Container registry host (e.g. gcr.io, asia.gcr.io). If omitted, inferred from --region")
+	noProgress := flag.Bool("no-progress", false, "Keep line-oriented logs but disable progress bars")
+	silent := flag.Bool("silent", false, "Discard crunchy's own step logs and progress bars; errors, the output of the commands it runs and the final done line are still printed")
+	builder := flag.String("builder", string(builderDocker), "Image build backend: docker|ggcr (buildkit is accepted but has no implementation; selecting it makes the run fail)")
+	platforms := flag.String("platforms", "linux/amd64", "Comma-separated target platforms (e.g. linux/amd64,linux/arm64)")
+	registry := flag.String("registry", "", "Container registry: gcr|artifact-registry. If omitted, inferred from --registry-host")
+	repository := flag.String("repository", "", "Artifact Registry repository name (required when --registry=artifact-registry)")
+	lang := flag.String("lang", "", "Project language/package manager (pnpm|npm|yarn|go|rust). If omitted, auto-detected")
+	dockerfile := flag.String("dockerfile", "", "Path to a Dockerfile, passed to docker build as -f")
+	configPath := flag.String("config", "crunchy.yaml", "Path to a crunchy.yaml multi-target config file")
+	only := flag.String("only", "", "Glob matched against each target's image name to deploy a subset")
+	env := flag.String("env", "", "Only run targets belonging to this --config environment")
 	flag.Parse()
 
-	if *image == "" {
-		return nil, errors.New("--image is required")
-	}
-
-	if *svc == "" {
-		return nil, errors.New("--svc is required")
-	}
-
-	services := splitServices(*svc)
-	if len(services) == 0 {
-		return nil, errors.New("no services provided via --svc")
-	}
-
 	if *keepImgs < 1 {
-		return nil, errors.New("--keep-images must be >= 1")
+		return nil, nil, errors.New("--keep-images must be >= 1")
 	}
-
 	if *keepRevs < 1 {
-		return nil, errors.New("--keep-revisions must be >= 1")
-	}
-
-	if *project == "" {
-		return nil, errors.New("--project is required")
-	}
-
-	if *region == "" {
-		return nil, errors.New("--region is required")
-	}
-
-	workdir, err := os.Getwd()
-	if err != nil {
-		return nil, fmt.Errorf("determine working directory: %w", err)
-	}
-
-	host := strings.TrimSpace(*registryHost)
-	if host == "" {
-		host = inferRegistryHost(*region)
-	}
-
-	return &config{
-		image:    *image,
-		beta:     *beta,
-		services: services,
-		workdir:  workdir,
-		start:    time.Now(),
-		keepImgs: *keepImgs,
-		keepRevs: *keepRevs,
-		project:  *project,
-		region:   *region,
-		registryHost: host,
-	}, nil
+		return nil, nil, errors.New("--keep-revisions must be >= 1")
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	return &flagValues{
+		image:        *image,
+		svc:          *svc,
+		beta:         *beta,
+		keepImgs:     *keepImgs,
+		keepRevs:     *keepRevs,
+		project:      *project,
+		region:       *region,
+		registryHost: *registryHost,
+		noProgress:   *noProgress,
+		silent:       *silent,
+		builder:      *builder,
+		platforms:    *platforms,
+		registry:     *registry,
+		repository:   *repository,
+		lang:         *lang,
+		dockerfile:   *dockerfile,
+		configPath:   *configPath,
+		only:         *only,
+		env:          *env,
+	}, set, nil
 }
 
 func splitServices(raw string) []string {
@@ -131,44 +198,58 @@ func inferRegistryHost(region string) string {
 	}
 }
 
-func run(cfg *config) error {
-	logStep(cfg, "Building TS...")
-	if err := runCommandStreaming(cfg.workdir, "pnpm", "run", "build"); err != nil {
+func run(ctx context.Context, cfg *config) error {
+	builder, err := newImageBuilder(cfg)
+	if err != nil {
+		return err
+	}
+
+	logStep(cfg, "Building project...")
+	if err := buildProject(ctx, cfg); err != nil {
 		return fmt.Errorf("build project: %w", err)
 	}
 
-	imageRepo := fmt.Sprintf("%s/%s/%s", cfg.registryHost, cfg.project, cfg.image)
+	imageRepo := buildImageRepo(cfg)
 	imageTag := imageRepo
 	if cfg.beta {
 		imageTag += ":dev"
 	}
 
-	logStep(cfg, "Building Docker...")
-	if err := runCommandStreaming(cfg.workdir, "docker", "build", "--platform", "linux/amd64", "-t", imageTag, "."); err != nil {
-		return fmt.Errorf("docker build: %w", err)
-	}
-
-	logStep(cfg, "Uploading image...")
-	pushOutput, err := runCommandCapture(cfg.workdir, "docker", "push", imageTag)
+	logStep(cfg, "Building image...")
+	img, err := builder.Build(ctx, cfg.workdir, imageTag)
 	if err != nil {
-		return fmt.Errorf("docker push: %w\n%s", err, pushOutput)
+		return fmt.Errorf("build image: %w", err)
 	}
 
-	digest, err := parseDigest(pushOutput)
+	logStep(cfg, "Uploading image...")
+	digest, err := builder.Push(ctx, img, imageTag)
 	if err != nil {
-		return fmt.Errorf("parse digest: %w\n%s", err, pushOutput)
+		return fmt.Errorf("push image: %w", err)
 	}
 
 	fullImagePath := fmt.Sprintf("%s@%s", imageRepo, digest)
 
+	var promoted atomic.Bool
 	logStep(cfg, "Deploying...")
-	if err := deployServices(cfg, fullImagePath); err != nil {
+	deployErr := deployServices(ctx, cfg, fullImagePath, &promoted)
+
+	if deployErr != nil && !cfg.beta && !promoted.Load() {
+		logStep(cfg, "Rolling back pushed image...")
+		if rbErr := rollbackPushedImage(cfg, imageRepo, digest); rbErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: rollback of %s@%s failed: %v\n", imageRepo, digest, rbErr)
+		}
+	}
+
+	if deployErr != nil {
+		return deployErr
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
 	if !cfg.beta {
 		logStep(cfg, "Cleaning up image...")
-		if err := cleanupOldImages(cfg, cfg.image); err != nil {
+		if err := cleanupOldImages(ctx, cfg, cfg.image); err != nil {
 			return err
 		}
 	}
@@ -176,12 +257,38 @@ func run(cfg *config) error {
 	return nil
 }
 
+// rollbackPushedImage best-effort deletes a digest that was pushed but never
+// promoted to any Cloud Run service, so an aborted run doesn't leave garbage
+// behind for the next attempt to trip over. It runs under its own context
+// with a 30-second timeout instead of the caller's, which may already have
+// been cancelled.
+func rollbackPushedImage(cfg *config, repo, digest string) error {
+	imageWithDigest := fmt.Sprintf("%s@%s", repo, digest)
+
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	deleteArgs := []string{"container", "images", "delete", imageWithDigest, "--force-delete-tags", "-q"}
+	if cfg.registryKind == registryArtifact {
+		deleteArgs = []string{"artifacts", "docker", "images", "delete", imageWithDigest, "-q"}
+	}
+
+	if out, err := runCommandCapture(cleanupCtx, cfg.workdir, "gcloud", deleteArgs...); err != nil {
+		return fmt.Errorf("delete digest %s: %w\n%s", imageWithDigest, err, out)
+	}
+
+	return nil
+}
+
 func logStep(cfg *config, message string) {
+	if cfg.silent {
+		return
+	}
 	fmt.Printf("%s (%.1fs)\n", message, time.Since(cfg.start).Seconds())
 }
 
-func runCommandStreaming(dir, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+func runCommandStreaming(ctx context.Context, dir, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = dir
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -190,8 +297,8 @@ func runCommandStreaming(dir, name string, args ...string) error {
 	return cmd.Run()
 }
 
-func runCommandCapture(dir, name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
+func runCommandCapture(ctx context.Context, dir, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Dir = dir
 	cmd.Env = os.Environ()
 	out, err := cmd.CombinedOutput()
@@ -219,7 +326,10 @@ func parseDigest(output string) (string, error) {
 	return "", errors.New("digest not found in output")
 }
 
-func deployServices(cfg *config, image string) error {
+func deployServices(ctx context.Context, cfg *config, image string, promoted *atomic.Bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var wg sync.WaitGroup
 	errs := make(chan error, len(cfg.services))
 
@@ -228,8 +338,9 @@ func deployServices(cfg *config, image string) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := deployService(cfg, service, image); err != nil {
+			if err := deployService(ctx, cfg, service, image, promoted); err != nil {
 				errs <- err
+				cancel()
 			}
 		}()
 	}
@@ -252,28 +363,34 @@ func deployServices(cfg *config, image string) error {
 	return nil
 }
 
-func deployService(cfg *config, service, image string) error {
-	revisions, err := listRevisions(cfg, service)
+func deployService(ctx context.Context, cfg *config, service, image string, promoted *atomic.Bool) error {
+	revisions, err := listRevisions(ctx, cfg, service)
 	if err != nil {
 		return fmt.Errorf("list revisions for %s: %w", service, err)
 	}
 
-	if err := runCommandStreaming(cfg.workdir, "gcloud", "run", "deploy", service,
-		"--image="+image,
+	deployArgs := []string{"run", "deploy", service,
+		"--image=" + image,
 		"--platform=managed",
-		"--region="+cfg.region,
-		"--project="+cfg.project,
-	); err != nil {
+		"--region=" + cfg.region,
+		"--project=" + cfg.project,
+	}
+	if err := runGcloudDeploy(ctx, cfg, service, deployArgs); err != nil {
 		return fmt.Errorf("deploy service %s: %w", service, err)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	logStep(cfg, fmt.Sprintf("Migrating %s...", service))
-	if err := runCommandStreaming(cfg.workdir, "gcloud", "run", "services", "update-traffic", service,
+	if err := runCommandStreaming(ctx, cfg.workdir, "gcloud", "run", "services", "update-traffic", service,
 		"--to-latest",
 		"--region="+cfg.region,
 	); err != nil {
 		return fmt.Errorf("update traffic for %s: %w", service, err)
 	}
+	promoted.Store(true)
 
 	logStep(cfg, fmt.Sprintf("Deployed %s.", service))
 
@@ -282,8 +399,12 @@ func deployService(cfg *config, service, image string) error {
 	}
 
 	for _, revision := range revisions[cfg.keepRevs:] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		logStep(cfg, fmt.Sprintf("Deleting %s...", revision))
-		if err := runCommandStreaming(cfg.workdir, "gcloud", "run", "revisions", "delete", revision,
+		if err := runCommandStreaming(ctx, cfg.workdir, "gcloud", "run", "revisions", "delete", revision,
 			"--region="+cfg.region,
 			"-q",
 		); err != nil {
@@ -295,8 +416,8 @@ func deployService(cfg *config, service, image string) error {
 	return nil
 }
 
-func listRevisions(cfg *config, service string) ([]string, error) {
-	output, err := runCommandCapture(cfg.workdir, "gcloud", "run", "revisions", "list",
+func listRevisions(ctx context.Context, cfg *config, service string) ([]string, error) {
+	output, err := runCommandCapture(ctx, cfg.workdir, "gcloud", "run", "revisions", "list",
 		"--region="+cfg.region,
 		"--service="+service,
 		`--format=value(metadata.name)`,
@@ -315,43 +436,3 @@ func listRevisions(cfg *config, service string) ([]string, error) {
 	return revisions, nil
 }
 
-func cleanupOldImages(cfg *config, image string) error {
-	repo := fmt.Sprintf("%s/%s/%s", cfg.registryHost, cfg.project, image)
-
-	output, err := runCommandCapture(cfg.workdir,
-		"gcloud", "container", "images", "list-tags", repo,
-		"--format=json",
-	)
-	if err != nil {
-		return fmt.Errorf("list image tags: %w\n%s", err, output)
-	}
-
-	var tags []struct {
-		Digest string `json:"digest"`
-	}
-	if err := json.Unmarshal([]byte(output), &tags); err != nil {
-		return fmt.Errorf("parse image tags json: %w", err)
-	}
-
-	if len(tags) <= cfg.keepImgs {
-		return nil
-	}
-
-	for _, tag := range tags[cfg.keepImgs:] {
-		if tag.Digest == "" {
-			continue
-		}
-		imageWithDigest := fmt.Sprintf("%s@%s", repo, tag.Digest)
-		logStep(cfg, fmt.Sprintf("Deleting %s...", imageWithDigest))
-		if err := runCommandStreaming(cfg.workdir, "gcloud", "container", "images", "delete",
-			imageWithDigest,
-			"--force-delete-tags",
-			"-q",
-		); err != nil {
-			return fmt.Errorf("delete image %s: %w", imageWithDigest, err)
-		}
-		logStep(cfg, fmt.Sprintf("Deleted %s.", imageWithDigest))
-	}
-
-	return nil
-}
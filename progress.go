@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/term"
+)
+
+// progressEnabled reports whether layer/deploy progress bars should be
+// rendered for this run. Bars only make sense on an interactive terminal,
+// and are suppressed by --no-progress and --silent.
+func progressEnabled(cfg *config) bool {
+	if cfg.noProgress || cfg.silent {
+		return false
+	}
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// runCommandPiped runs cmd and feeds each line of combined stdout/stderr to
+// onLine as it arrives, in addition to buffering the full output for callers
+// that still need to parse it afterwards (e.g. parseDigest).
+func runCommandPiped(ctx context.Context, dir, name string, args []string, onLine func(stream, line string)) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return "", fmt.Errorf("stderr pipe: %w", err)
+	}
+
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	scan := func(r io.Reader, stream string) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			mu.Lock()
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			mu.Unlock()
+
+			if onLine != nil {
+				onLine(stream, line)
+			}
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); scan(stdout, "stdout") }()
+	go func() { defer wg.Done(); scan(stderr, "stderr") }()
+	wg.Wait()
+
+	return buf.String(), cmd.Wait()
+}
+
+// runDockerCommand runs a docker subcommand, rendering per-layer progress
+// bars when the terminal and flags allow it, and falling back to plain
+// streaming output otherwise (CI logs, --no-progress, --silent).
+func runDockerCommand(ctx context.Context, cfg *config, args []string) error {
+	if !progressEnabled(cfg) {
+		return runCommandStreaming(ctx, cfg.workdir, "docker", args...)
+	}
+
+	tracker := newLayerTracker()
+	defer tracker.close()
+
+	output, err := runCommandPiped(ctx, cfg.workdir, "docker", args, func(stream, line string) {
+		tracker.handleLine(line)
+	})
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, output)
+	}
+	return nil
+}
+
+// runDockerPush is the progress-aware counterpart of runCommandCapture for
+// `docker push`: it still returns the full combined output so parseDigest
+// keeps working, but additionally renders a bar per layer when possible.
+func runDockerPush(ctx context.Context, cfg *config, imageTag string) (string, error) {
+	if !progressEnabled(cfg) {
+		return runCommandCapture(ctx, cfg.workdir, "docker", "push", imageTag)
+	}
+
+	tracker := newLayerTracker()
+	defer tracker.close()
+
+	return runCommandPiped(ctx, cfg.workdir, "docker", []string{"push", imageTag}, func(stream, line string) {
+		tracker.handleLine(line)
+	})
+}
+
+// runGcloudDeploy streams `gcloud run deploy` output, driving a spinner bar
+// for the service keyed off its "Deploying.../Routing traffic..." lines when
+// progress rendering is enabled.
+func runGcloudDeploy(ctx context.Context, cfg *config, service string, args []string) error {
+	if !progressEnabled(cfg) {
+		return runCommandStreaming(ctx, cfg.workdir, "gcloud", args...)
+	}
+
+	spinner := newDeploySpinner(service)
+	defer spinner.finish()
+
+	output, err := runCommandPiped(ctx, cfg.workdir, "gcloud", args, func(stream, line string) {
+		spinner.handleLine(line)
+	})
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, output)
+	}
+	return nil
+}
+
+// dockerLayerLineRe matches lines like:
+//   a1b2c3d4e5f6: Pushing [==========>     ]  23.4MB/45.1MB
+//   a1b2c3d4e5f6: Pushed
+//   a1b2c3d4e5f6: Layer already exists
+var dockerLayerLineRe = regexp.MustCompile(`^([0-9a-f]{12}): (Pushing|Pushed|Preparing|Waiting|Layer already exists)(?:\s+\[[^\]]*\]\s+([0-9.]+\s?\w+)/([0-9.]+\s?\w+))?`)
+
+// layerTracker maintains one progress bar per image layer, pooled so they
+// render as a stable multi-line block instead of scrolling the terminal.
+type layerTracker struct {
+	mu   sync.Mutex
+	pool *pb.Pool
+	bars map[string]*pb.ProgressBar
+}
+
+func newLayerTracker() *layerTracker {
+	return &layerTracker{bars: make(map[string]*pb.ProgressBar)}
+}
+
+func (t *layerTracker) handleLine(line string) {
+	match := dockerLayerLineRe.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	layerID, status := match[1], match[2]
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bar, ok := t.bars[layerID]
+	if !ok {
+		bar = pb.New(100).SetTemplateString(`{{string . "label"}} {{bar . }} {{speed . }} {{etime . }}`)
+		bar.Set("label", layerID)
+
+		if t.pool == nil {
+			t.pool = pb.NewPool()
+			_ = t.pool.Start()
+		}
+		t.pool.Add(bar)
+		t.bars[layerID] = bar
+	}
+
+	switch status {
+	case "Pushed", "Layer already exists":
+		bar.SetCurrent(bar.Total())
+		bar.Finish()
+	case "Pushing":
+		if cur, total := parseByteSize(match[3]), parseByteSize(match[4]); total > 0 {
+			bar.SetTotal(total)
+			bar.SetCurrent(cur)
+		}
+	}
+}
+
+func (t *layerTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pool != nil {
+		_ = t.pool.Stop()
+	}
+}
+
+func parseByteSize(s string) int64 {
+	s = strings.TrimSpace(s)
+	if len(s) < 3 {
+		return 0
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(s[len(s)-2:]))
+	var multiplier float64
+	switch unit {
+	case "KB":
+		multiplier = 1 << 10
+	case "MB":
+		multiplier = 1 << 20
+	case "GB":
+		multiplier = 1 << 30
+	default:
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return int64(n)
+		}
+		return 0
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, s[len(s)-2:])), 64)
+	if err != nil {
+		return 0
+	}
+	return int64(n * multiplier)
+}
+
+// deploySpinner drives a single spinner bar for a Cloud Run service while
+// `gcloud run deploy` is in progress.
+type deploySpinner struct {
+	service string
+	bar     *pb.ProgressBar
+}
+
+func newDeploySpinner(service string) *deploySpinner {
+	bar := pb.New(0)
+	bar.SetTemplateString(`{{(cycle . "⠋" "⠙" "⠹" "⠸" "⠼" "⠴" "⠦" "⠧" "⠇" "⠏")}} {{string . "label"}}`)
+	bar.Set("label", fmt.Sprintf("%s: starting...", service))
+	bar.Start()
+	return &deploySpinner{service: service, bar: bar}
+}
+
+func (s *deploySpinner) handleLine(line string) {
+	switch {
+	case strings.Contains(line, "Deploying..."):
+		s.bar.Set("label", fmt.Sprintf("%s: deploying...", s.service))
+	case strings.Contains(line, "Routing traffic..."):
+		s.bar.Set("label", fmt.Sprintf("%s: routing traffic...", s.service))
+	}
+}
+
+func (s *deploySpinner) finish() {
+	s.bar.Finish()
+}
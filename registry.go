@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type registryKind string
+
+const (
+	registryGCR      registryKind = "gcr"
+	registryArtifact registryKind = "artifact-registry"
+)
+
+// parseRegistryKind resolves --registry, auto-detecting Artifact Registry by
+// probing whether the registry host as configured ends in pkg.dev. It runs
+// before any host inference, so an empty host resolves to GCR.
+func parseRegistryKind(raw, host string) (registryKind, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	switch raw {
+	case "":
+		if strings.HasSuffix(strings.ToLower(host), "pkg.dev") {
+			return registryArtifact, nil
+		}
+		return registryGCR, nil
+	case string(registryGCR):
+		return registryGCR, nil
+	case string(registryArtifact):
+		return registryArtifact, nil
+	default:
+		return "", fmt.Errorf("unsupported --registry value %q", raw)
+	}
+}
+
+func buildImageRepo(cfg *config) string {
+	if cfg.registryKind == registryArtifact {
+		return fmt.Sprintf("%s/%s/%s/%s", cfg.registryHost, cfg.project, cfg.repository, cfg.image)
+	}
+	return fmt.Sprintf("%s/%s/%s", cfg.registryHost, cfg.project, cfg.image)
+}
+
+func cleanupOldImages(ctx context.Context, cfg *config, image string) error {
+	if cfg.registryKind == registryArtifact {
+		return cleanupOldArtifactImages(ctx, cfg, image)
+	}
+	return cleanupOldGCRImages(ctx, cfg, image)
+}
+
+func cleanupOldGCRImages(ctx context.Context, cfg *config, image string) error {
+	repo := fmt.Sprintf("%s/%s/%s", cfg.registryHost, cfg.project, image)
+
+	output, err := runCommandCapture(ctx, cfg.workdir,
+		"gcloud", "container", "images", "list-tags", repo,
+		"--format=json",
+	)
+	if err != nil {
+		return fmt.Errorf("list image tags: %w\n%s", err, output)
+	}
+
+	var tags []struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal([]byte(output), &tags); err != nil {
+		return fmt.Errorf("parse image tags json: %w", err)
+	}
+
+	if len(tags) <= cfg.keepImgs {
+		return nil
+	}
+
+	keepDigests := make([]string, 0, cfg.keepImgs)
+	for _, tag := range tags[:cfg.keepImgs] {
+		if tag.Digest != "" {
+			keepDigests = append(keepDigests, tag.Digest)
+		}
+	}
+	retainedChildren := retainedChildDigests(ctx, repo, keepDigests)
+
+	for _, tag := range tags[cfg.keepImgs:] {
+		if tag.Digest == "" {
+			continue
+		}
+		if retainedChildren[tag.Digest] {
+			logStep(cfg, fmt.Sprintf("Keeping %s@%s (referenced by a retained manifest list)", repo, tag.Digest))
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		imageWithDigest := fmt.Sprintf("%s@%s", repo, tag.Digest)
+		logStep(cfg, fmt.Sprintf("Deleting %s...", imageWithDigest))
+		if err := runCommandStreaming(ctx, cfg.workdir, "gcloud", "container", "images", "delete",
+			imageWithDigest,
+			"--force-delete-tags",
+			"-q",
+		); err != nil {
+			return fmt.Errorf("delete image %s: %w", imageWithDigest, err)
+		}
+		logStep(cfg, fmt.Sprintf("Deleted %s.", imageWithDigest))
+	}
+
+	return nil
+}
+
+// cleanupOldArtifactImages is the Artifact Registry counterpart of
+// cleanupOldGCRImages: `gcloud container images` doesn't work against
+// pkg.dev hosts, so this uses the `gcloud artifacts docker images`
+// command group instead and sorts by updateTime since Artifact Registry
+// doesn't return results pre-sorted the way list-tags does.
+func cleanupOldArtifactImages(ctx context.Context, cfg *config, image string) error {
+	repo := fmt.Sprintf("%s/%s/%s/%s", cfg.registryHost, cfg.project, cfg.repository, image)
+
+	output, err := runCommandCapture(ctx, cfg.workdir,
+		"gcloud", "artifacts", "docker", "images", "list", repo,
+		"--include-tags",
+		"--format=json",
+	)
+	if err != nil {
+		return fmt.Errorf("list artifact registry images: %w\n%s", err, output)
+	}
+
+	var versions []struct {
+		Digest     string `json:"version"`
+		UpdateTime string `json:"updateTime"`
+	}
+	if err := json.Unmarshal([]byte(output), &versions); err != nil {
+		return fmt.Errorf("parse artifact registry images json: %w", err)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].UpdateTime > versions[j].UpdateTime
+	})
+
+	if len(versions) <= cfg.keepImgs {
+		return nil
+	}
+
+	keepDigests := make([]string, 0, cfg.keepImgs)
+	for _, v := range versions[:cfg.keepImgs] {
+		if v.Digest != "" {
+			keepDigests = append(keepDigests, v.Digest)
+		}
+	}
+	retainedChildren := retainedChildDigests(ctx, repo, keepDigests)
+
+	for _, v := range versions[cfg.keepImgs:] {
+		if v.Digest == "" {
+			continue
+		}
+		if retainedChildren[v.Digest] {
+			logStep(cfg, fmt.Sprintf("Keeping %s@%s (referenced by a retained manifest list)", repo, v.Digest))
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		imageWithDigest := fmt.Sprintf("%s@%s", repo, v.Digest)
+		logStep(cfg, fmt.Sprintf("Deleting %s...", imageWithDigest))
+		if err := runCommandStreaming(ctx, cfg.workdir, "gcloud", "artifacts", "docker", "images", "delete",
+			imageWithDigest,
+			"-q",
+		); err != nil {
+			return fmt.Errorf("delete image %s: %w", imageWithDigest, err)
+		}
+		logStep(cfg, fmt.Sprintf("Deleted %s.", imageWithDigest))
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the schema of crunchy.yaml: named environments carrying
+// shared GCP settings, and a list of targets that each deploy one image to
+// one environment.
+type fileConfig struct {
+	Environments map[string]fileEnvironment `yaml:"environments"`
+	Targets      []fileTarget               `yaml:"targets"`
+}
+
+type fileEnvironment struct {
+	Project       string `yaml:"project"`
+	Region        string `yaml:"region"`
+	RegistryHost  string `yaml:"registryHost"`
+	Repository    string `yaml:"repository"`
+	KeepImages    int    `yaml:"keepImages"`
+	KeepRevisions int    `yaml:"keepRevisions"`
+}
+
+type fileTarget struct {
+	Image      string   `yaml:"image"`
+	Lang       string   `yaml:"lang"`
+	Dockerfile string   `yaml:"dockerfile"`
+	Context    string   `yaml:"context"`
+	Services   []string `yaml:"services"`
+	Platforms  []string `yaml:"platforms"`
+	Env        string   `yaml:"env"`
+}
+
+// loadFileConfig reads crunchy.yaml. A missing file at the default path is
+// not an error: it just means the caller should fall back to the original
+// flag-only, single-target mode. A missing file at an explicitly passed
+// --config path is an error, since the user asked for it by name.
+func loadFileConfig(path string, explicit bool) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config file %s: %w", path, err)
+	}
+
+	var fc fileConfig
+	if err := yaml.Unmarshal(data, &fc); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return &fc, nil
+}
+
+// resolveTargets decides between crunchy.yaml multi-target mode and the
+// original flag-only single-target mode, returning one *config per target
+// to run in order.
+func resolveTargets(flags *flagValues, set map[string]bool) ([]*config, error) {
+	fc, err := loadFileConfig(flags.configPath, set["config"])
+	if err != nil {
+		return nil, err
+	}
+
+	if fc == nil {
+		cfg, err := buildFlagOnlyConfig(flags)
+		if err != nil {
+			return nil, err
+		}
+		return []*config{cfg}, nil
+	}
+
+	targets := make([]*config, 0, len(fc.Targets))
+	for _, t := range fc.Targets {
+		if flags.only != "" {
+			matched, err := filepath.Match(flags.only, t.Image)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --only pattern %q: %w", flags.only, err)
+			}
+			if !matched {
+				continue
+			}
+		}
+		if flags.env != "" && t.Env != flags.env {
+			continue
+		}
+
+		var env fileEnvironment
+		if t.Env != "" {
+			var ok bool
+			env, ok = fc.Environments[t.Env]
+			if !ok {
+				return nil, fmt.Errorf("target %q references unknown environment %q", t.Image, t.Env)
+			}
+		}
+
+		cfg, err := buildTargetConfig(t, env, flags, set)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", firstNonEmpty(t.Image, "<unnamed>"), err)
+		}
+		targets = append(targets, cfg)
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no targets in --config matched the --only/--env selectors")
+	}
+
+	return targets, nil
+}
+
+// buildFlagOnlyConfig reproduces crunchy's original single-invocation
+// behavior when no crunchy.yaml is present.
+func buildFlagOnlyConfig(flags *flagValues) (*config, error) {
+	if flags.image == "" {
+		return nil, errors.New("--image is required")
+	}
+
+	services := splitServices(flags.svc)
+	if len(services) == 0 {
+		return nil, errors.New("--svc is required")
+	}
+
+	if flags.project == "" {
+		return nil, errors.New("--project is required")
+	}
+
+	if flags.region == "" {
+		return nil, errors.New("--region is required")
+	}
+
+	return finishConfig(flags, flags.image, services, flags.project, flags.region,
+		flags.registryHost, flags.repository, flags.keepImgs, flags.keepRevs, parsePlatforms(flags.platforms),
+		flags.lang, flags.dockerfile, "", "")
+}
+
+// buildTargetConfig merges one crunchy.yaml target with its environment and
+// then with any flags the user explicitly passed on the command line, which
+// always win over the file.
+func buildTargetConfig(t fileTarget, env fileEnvironment, flags *flagValues, set map[string]bool) (*config, error) {
+	image := t.Image
+	if set["image"] {
+		image = flags.image
+	}
+	if image == "" {
+		return nil, errors.New("--image or targets[].image is required")
+	}
+
+	services := t.Services
+	if set["svc"] {
+		services = splitServices(flags.svc)
+	}
+	if len(services) == 0 {
+		return nil, errors.New("--svc or targets[].services is required")
+	}
+
+	project := env.Project
+	if set["project"] {
+		project = flags.project
+	}
+	if project == "" {
+		return nil, errors.New("--project or environments[].project is required")
+	}
+
+	region := env.Region
+	if set["region"] {
+		region = flags.region
+	}
+	if region == "" {
+		return nil, errors.New("--region or environments[].region is required")
+	}
+
+	registryHost := env.RegistryHost
+	if set["registry-host"] {
+		registryHost = flags.registryHost
+	}
+
+	repository := env.Repository
+	if set["repository"] {
+		repository = flags.repository
+	}
+
+	keepImgs := flags.keepImgs
+	if env.KeepImages > 0 && !set["keep-images"] {
+		keepImgs = env.KeepImages
+	}
+
+	keepRevs := flags.keepRevs
+	if env.KeepRevisions > 0 && !set["keep-revisions"] {
+		keepRevs = env.KeepRevisions
+	}
+
+	platforms := t.Platforms
+	if set["platforms"] || len(platforms) == 0 {
+		platforms = parsePlatforms(flags.platforms)
+	}
+
+	dockerfile := t.Dockerfile
+	if set["dockerfile"] {
+		dockerfile = flags.dockerfile
+	}
+
+	lang := t.Lang
+	if set["lang"] {
+		lang = flags.lang
+	}
+
+	label := fmt.Sprintf("%s (%s)", image, firstNonEmpty(t.Env, "default"))
+
+	return finishConfig(flags, image, services, project, region, registryHost, repository,
+		keepImgs, keepRevs, platforms, lang, dockerfile, t.Context, label)
+}
+
+// finishConfig applies the settings shared by both modes (workdir/context,
+// registry/builder selection, language detection) to produce a *config.
+func finishConfig(flags *flagValues, image string, services []string, project, region, registryHost, repository string,
+	keepImgs, keepRevs int, platforms []string, lang, dockerfile, contextDir, label string) (*config, error) {
+
+	builderKindVal, err := parseBuilderKind(flags.builder)
+	if err != nil {
+		return nil, err
+	}
+
+	host := strings.TrimSpace(registryHost)
+	registryKindVal, err := parseRegistryKind(flags.registry, host)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		if registryKindVal == registryArtifact {
+			host = fmt.Sprintf("%s-docker.pkg.dev", region)
+		} else {
+			host = inferRegistryHost(region)
+		}
+	}
+	repository = strings.TrimSpace(repository)
+	if registryKindVal == registryArtifact && repository == "" {
+		return nil, errors.New("--repository or environments[].repository is required when --registry=artifact-registry")
+	}
+
+	if len(platforms) == 0 {
+		return nil, errors.New("at least one platform is required")
+	}
+
+	repoRoot, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("determine working directory: %w", err)
+	}
+	workdir := repoRoot
+	if contextDir != "" {
+		workdir = filepath.Join(repoRoot, contextDir)
+	}
+
+	// Resolve a relative --dockerfile/dockerfile against the repo root, not
+	// the per-target context dir, so a Dockerfile shared across targets
+	// keeps working regardless of each target's build context.
+	if dockerfile != "" && !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(repoRoot, dockerfile)
+	}
+
+	langVal, err := determineLanguage(workdir, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config{
+		image:        image,
+		beta:         flags.beta,
+		services:     services,
+		workdir:      workdir,
+		keepImgs:     keepImgs,
+		keepRevs:     keepRevs,
+		project:      project,
+		region:       region,
+		registryHost: host,
+		noProgress:   flags.noProgress,
+		silent:       flags.silent,
+		builder:      builderKindVal,
+		platforms:    platforms,
+		registryKind: registryKindVal,
+		repository:   repository,
+		lang:         langVal,
+		dockerfile:   dockerfile,
+		targetLabel:  label,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}